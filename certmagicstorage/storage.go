@@ -0,0 +1,238 @@
+// Package certmagicstorage implements the certmagic.Storage interface on
+// top of B2.
+//
+// Unlike the legacy tlsb2.b2Storage, which wraps caddytls's SiteData/UserData
+// structures in a JSON envelope, this package maps keys 1:1 to B2 file
+// names: each asset CertMagic asks us to store (a ".crt", a ".key", a
+// ".json" metadata file, ...) becomes its own B2 file, with no wrapping.
+//
+// Retries, distributed locking and optional client-side encryption are not
+// reimplemented here: they're shared with tlsb2's caddytls.Storage backends
+// via internal/objectstore, so this package gets the same guarantees for
+// free.
+package certmagicstorage // import "rischmann.fr/caddy-tlsb2/certmagicstorage"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FiloSottile/b2"
+	"github.com/caddyserver/certmagic"
+
+	"rischmann.fr/caddy-tlsb2"
+	"rischmann.fr/caddy-tlsb2/internal/objectstore"
+)
+
+// Storage implements certmagic.Storage on top of a B2 bucket.
+type Storage struct {
+	store  objectstore.Store
+	locker *objectstore.Locker
+
+	// encryptionKey, if non-nil, is the 32-byte AES-256 key used to
+	// envelope values written by Store. See
+	// internal/objectstore/encryption.go.
+	encryptionKey []byte
+}
+
+// New creates a new certmagic.Storage backed by B2 for the given Certificate
+// Authority URL. Credentials are read from the same environment variables as
+// tlsb2.NewB2Storage ($B2_ACCOUNT_ID, $B2_ACCOUNT_KEY, $B2_BUCKET), plus
+// $B2_LOCK_TTL to override the default lock TTL and
+// $B2_ENCRYPTION_KEY/$B2_ENCRYPTION_KEY_FILE to enable client-side envelope
+// encryption.
+func New(caURL *url.URL) (certmagic.Storage, error) {
+	accountID := os.Getenv(tlsb2.EnvNameAccountID)
+	if accountID == "" {
+		return nil, fmt.Errorf("no account ID set, please set $%s", tlsb2.EnvNameAccountID)
+	}
+	accountKey := os.Getenv(tlsb2.EnvNameAccountKey)
+	if accountKey == "" {
+		return nil, fmt.Errorf("no account key set, please set $%s", tlsb2.EnvNameAccountKey)
+	}
+	bucketID := os.Getenv(tlsb2.EnvNameBucket)
+	if bucketID == "" {
+		return nil, fmt.Errorf("no bucket set, please set $%s", tlsb2.EnvNameBucket)
+	}
+
+	client, err := b2.NewClient(accountID, accountKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	lockTTL := objectstore.DefaultLockTTL
+	if v := os.Getenv(tlsb2.EnvNameLockTTL); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", tlsb2.EnvNameLockTTL, err)
+		}
+		lockTTL = d
+	}
+
+	encryptionKey, err := objectstore.LoadEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	store := objectstore.NewB2Store(client, bucketID)
+
+	return &Storage{
+		store:         store,
+		locker:        objectstore.NewLocker(store, lockTTL),
+		encryptionKey: encryptionKey,
+	}, nil
+}
+
+// Store saves value at key. If s.encryptionKey is configured, value is
+// sealed into an encryption envelope first.
+func (s *Storage) Store(ctx context.Context, key string, value []byte) error {
+	payload := value
+
+	if s.encryptionKey != nil {
+		sealed, err := objectstore.EncryptEnvelope(s.encryptionKey, value)
+		if err != nil {
+			return fmt.Errorf("certmagicstorage: Store(%q): %v", key, err)
+		}
+		payload = sealed
+	}
+
+	if err := s.store.Put(ctx, key, payload, ""); err != nil {
+		return fmt.Errorf("certmagicstorage: Store(%q): %v", key, err)
+	}
+
+	return nil
+}
+
+// Load retrieves the value at key, transparently decrypting it if it was
+// stored as an encryption envelope. Unencrypted values continue to load
+// as-is, so a bucket written before an encryption key was configured keeps
+// working.
+func (s *Storage) Load(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.store.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, objectstore.ErrNotExist) {
+			return nil, certmagic.ErrNotExist(err)
+		}
+		return nil, fmt.Errorf("certmagicstorage: Load(%q): %v", key, err)
+	}
+
+	if env, ok := objectstore.LooksLikeEnvelope(data); ok {
+		if s.encryptionKey == nil {
+			return nil, fmt.Errorf("certmagicstorage: Load(%q): value is encrypted but no encryption key is configured", key)
+		}
+
+		data, err = objectstore.DecryptEnvelope(s.encryptionKey, env)
+		if err != nil {
+			return nil, fmt.Errorf("certmagicstorage: Load(%q): decrypt: %v", key, err)
+		}
+	}
+
+	return data, nil
+}
+
+// Delete deletes key.
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	if err := s.store.Delete(ctx, key); err != nil {
+		if errors.Is(err, objectstore.ErrNotExist) {
+			return certmagic.ErrNotExist(err)
+		}
+		return fmt.Errorf("certmagicstorage: Delete(%q): %v", key, err)
+	}
+
+	return nil
+}
+
+// Exists returns true if key exists.
+func (s *Storage) Exists(ctx context.Context, key string) bool {
+	_, err := s.store.Stat(ctx, key)
+	return err == nil
+}
+
+// List returns all keys under prefix. When recursive is false, keys that
+// share a "directory" segment below prefix are collapsed into a single
+// entry for that segment, the way a delimited B2 listing would.
+func (s *Storage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	var keys []string
+	seen := make(map[string]bool)
+
+	it := s.store.List(ctx, prefix)
+	for it.Next() {
+		name := it.Key()
+
+		if !recursive {
+			rest := strings.TrimPrefix(name, prefix)
+			if idx := strings.Index(rest, "/"); idx >= 0 {
+				name = prefix + rest[:idx+1]
+			}
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			keys = append(keys, name)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("certmagicstorage: List(%q): %v", prefix, err)
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Stat returns information about key.
+func (s *Storage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	info, err := s.store.Stat(ctx, key)
+	if err != nil {
+		if errors.Is(err, objectstore.ErrNotExist) {
+			return certmagic.KeyInfo{}, certmagic.ErrNotExist(err)
+		}
+		return certmagic.KeyInfo{}, fmt.Errorf("certmagicstorage: Stat(%q): %v", key, err)
+	}
+
+	return certmagic.KeyInfo{
+		Key:        info.Key,
+		Modified:   info.ModTime,
+		Size:       info.Size,
+		IsTerminal: true,
+	}, nil
+}
+
+// Lock acquires the lock for name, blocking until it is held or ctx is
+// done. See internal/objectstore.Locker for the underlying algorithm.
+func (s *Storage) Lock(ctx context.Context, name string) error {
+	for {
+		waiter, err := s.locker.TryLock(ctx, name)
+		if err != nil {
+			return fmt.Errorf("certmagicstorage: Lock(%q): %v", name, err)
+		}
+		if waiter == nil {
+			return nil
+		}
+
+		done := make(chan struct{})
+		go func() {
+			waiter.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+		}
+	}
+}
+
+// Unlock releases the lock for name.
+func (s *Storage) Unlock(ctx context.Context, name string) error {
+	if err := s.locker.Unlock(ctx, name); err != nil {
+		return fmt.Errorf("certmagicstorage: Unlock(%q): %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// +build full
+
+package certmagicstorage
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"testing"
+)
+
+const testCAURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+func initStorage(t *testing.T) *Storage {
+	caURL, _ := url.Parse(testCAURL)
+
+	s, err := New(caURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s.(*Storage)
+}
+
+func TestStoreLoadDeleteExists(t *testing.T) {
+	s := initStorage(t)
+	ctx := context.Background()
+
+	const key = "certmagic_test/foobar.com.crt"
+	value := []byte("hello world")
+
+	t.Run("ExistsBeforeStore", func(t *testing.T) {
+		if s.Exists(ctx, key) {
+			t.Errorf("expected key to not exist")
+		}
+	})
+
+	t.Run("Store", func(t *testing.T) {
+		if err := s.Store(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ExistsAfterStore", func(t *testing.T) {
+		if !s.Exists(ctx, key) {
+			t.Errorf("expected key to exist")
+		}
+	})
+
+	t.Run("Load", func(t *testing.T) {
+		data, err := s.Load(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, value) {
+			t.Fatalf("expected %q, got %q", value, data)
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := s.Stat(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != key {
+			t.Fatalf("expected key %q, got %q", key, info.Key)
+		}
+		if info.Size != int64(len(value)) {
+			t.Fatalf("expected size %d, got %d", len(value), info.Size)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		keys, err := s.List(ctx, "certmagic_test/", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var found bool
+		for _, k := range keys {
+			if k == key {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected %q in %v", key, keys)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := s.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ExistsAfterDelete", func(t *testing.T) {
+		if s.Exists(ctx, key) {
+			t.Errorf("expected key to not exist anymore")
+		}
+	})
+}
+
+// TestStoreLoadWithEncryption stores and loads a value under both
+// plaintext and encrypted modes, and checks that the encrypted payload on
+// disk does not contain the plaintext.
+func TestStoreLoadWithEncryption(t *testing.T) {
+	s := initStorage(t)
+	ctx := context.Background()
+
+	const key = "certmagic_test/encrypted.example.com.key"
+	value := []byte("super-secret-private-key-bytes")
+
+	t.Run("plaintext", func(t *testing.T) {
+		s.encryptionKey = nil
+
+		if err := s.Store(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := s.Load(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, value) {
+			t.Fatalf("expected %q, got %q", value, data)
+		}
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		key32 := make([]byte, 32)
+		for i := range key32 {
+			key32[i] = byte(i)
+		}
+		s.encryptionKey = key32
+
+		if err := s.Store(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := s.store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, value) {
+			t.Fatalf("expected the stored payload to not contain the plaintext value")
+		}
+
+		data, err := s.Load(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, value) {
+			t.Fatalf("expected %q, got %q", value, data)
+		}
+	})
+
+	s.encryptionKey = nil
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockUnlock(t *testing.T) {
+	s := initStorage(t)
+	ctx := context.Background()
+
+	const name = "certmagic-lock-test"
+
+	if err := s.Lock(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Unlock(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,30 @@
+// Command tlsb2-migrate-encrypt rewrites every site and user object in a
+// bucket so that it is sealed in an encryption envelope, using the B2
+// credentials and encryption key configured via the usual tlsb2 environment
+// variables ($B2_ACCOUNT_ID, $B2_ACCOUNT_KEY, $B2_BUCKET,
+// $B2_ENCRYPTION_KEY/$B2_ENCRYPTION_KEY_FILE).
+package main
+
+import (
+	"flag"
+	"log"
+	"net/url"
+
+	"rischmann.fr/caddy-tlsb2"
+)
+
+func main() {
+	flag.Parse()
+
+	storage, err := tlsb2.NewB2Storage(&url.URL{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	migrated, err := tlsb2.MigrateEncrypt(storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("migrated %d object(s) to encrypted storage", migrated)
+}
@@ -0,0 +1,202 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/FiloSottile/b2"
+)
+
+// b2Store implements Store on top of a B2 bucket.
+type b2Store struct {
+	client   *b2.Client
+	bucketID string
+}
+
+// NewB2Store creates a Store backed by the B2 bucket identified by
+// bucketID, using client for API calls.
+func NewB2Store(client *b2.Client, bucketID string) Store {
+	return &b2Store{client: client, bucketID: bucketID}
+}
+
+// b2Store also implements VersionedStore, since B2 keeps multiple live
+// versions of a file around natively and lets us list/delete them
+// individually. Locker uses this to give B2 the race-free locking algorithm
+// from request #1 instead of the best-effort fallback.
+var _ VersionedStore = (*b2Store)(nil)
+
+func (s *b2Store) bucket() *b2.Bucket {
+	return s.client.BucketByID(s.bucketID)
+}
+
+func isB2NotFound(err error) bool {
+	v, ok := b2.UnwrapError(err)
+	if !ok {
+		return false
+	}
+	return v.Status == http.StatusNotFound
+}
+
+func (s *b2Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return Retry(ctx, func() error {
+		_, err := s.bucket().Upload(bytes.NewBuffer(data), key, contentType)
+		return err
+	})
+}
+
+func (s *b2Store) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+
+	err := Retry(ctx, func() error {
+		fi, err := s.bucket().GetFileInfoByName(key)
+		if err != nil {
+			if isB2NotFound(err) {
+				return ErrNotExist
+			}
+			return err
+		}
+
+		rd, _, err := s.client.DownloadFileByID(fi.ID)
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+
+		data, err = ioutil.ReadAll(rd)
+		return err
+	})
+
+	return data, err
+}
+
+func (s *b2Store) Delete(ctx context.Context, key string) error {
+	return Retry(ctx, func() error {
+		fi, err := s.bucket().GetFileInfoByName(key)
+		if err != nil {
+			if isB2NotFound(err) {
+				return ErrNotExist
+			}
+			return err
+		}
+
+		return s.client.DeleteFile(fi.ID, key)
+	})
+}
+
+func (s *b2Store) Stat(ctx context.Context, key string) (Info, error) {
+	var info Info
+
+	err := Retry(ctx, func() error {
+		fi, err := s.bucket().GetFileInfoByName(key)
+		if err != nil {
+			if isB2NotFound(err) {
+				return ErrNotExist
+			}
+			return err
+		}
+
+		info = Info{Key: fi.Name, Size: int64(fi.ContentLength), ModTime: fi.UploadTimestamp}
+		return nil
+	})
+
+	return info, err
+}
+
+func (s *b2Store) List(ctx context.Context, prefix string) Iterator {
+	return &b2Iterator{lister: s.bucket().ListFiles(prefix), prefix: prefix}
+}
+
+// PutVersion implements VersionedStore by uploading data as a new B2 file
+// version and returning its file ID.
+func (s *b2Store) PutVersion(ctx context.Context, key string, data []byte, contentType string) (string, error) {
+	var id string
+
+	err := Retry(ctx, func() error {
+		fi, err := s.bucket().Upload(bytes.NewBuffer(data), key, contentType)
+		if err != nil {
+			return err
+		}
+		id = fi.ID
+		return nil
+	})
+
+	return id, err
+}
+
+// ListVersions implements VersionedStore using B2's native file version
+// listing, which is exactly the "list versions for this name" primitive
+// distributed locking over B2 relies on.
+func (s *b2Store) ListVersions(ctx context.Context, key string) ([]Version, error) {
+	var versions []Version
+
+	err := Retry(ctx, func() error {
+		versions = nil
+
+		l := s.bucket().ListFilesVersions(key, "")
+		for l.Next() {
+			fi := l.FileInfo()
+			if fi.Name != key {
+				continue
+			}
+			versions = append(versions, Version{ID: fi.ID, ModTime: fi.UploadTimestamp})
+		}
+		return l.Err()
+	})
+
+	return versions, err
+}
+
+// GetVersion implements VersionedStore by downloading the specific file ID.
+func (s *b2Store) GetVersion(ctx context.Context, key string, id string) ([]byte, error) {
+	var data []byte
+
+	err := Retry(ctx, func() error {
+		rd, _, err := s.client.DownloadFileByID(id)
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+
+		data, err = ioutil.ReadAll(rd)
+		return err
+	})
+
+	return data, err
+}
+
+// DeleteVersion implements VersionedStore by deleting the specific file ID.
+func (s *b2Store) DeleteVersion(ctx context.Context, key string, id string) error {
+	return Retry(ctx, func() error {
+		return s.client.DeleteFile(id, key)
+	})
+}
+
+type b2Iterator struct {
+	lister *b2.Listing
+	prefix string
+	info   Info
+}
+
+// Next implements Iterator. ListFiles/ListFilesVersions don't filter by
+// prefix: they just start an alphabetically-sorted scan from prefix to the
+// end of the bucket. So we filter here, and since the scan is sorted, the
+// first name we see that doesn't match prefix means every later name won't
+// either, and we can stop.
+func (it *b2Iterator) Next() bool {
+	if !it.lister.Next() {
+		return false
+	}
+	fi := it.lister.FileInfo()
+	if !strings.HasPrefix(fi.Name, it.prefix) {
+		return false
+	}
+	it.info = Info{Key: fi.Name, Size: int64(fi.ContentLength), ModTime: fi.UploadTimestamp}
+	return true
+}
+
+func (it *b2Iterator) Key() string { return it.info.Key }
+func (it *b2Iterator) Info() Info  { return it.info }
+func (it *b2Iterator) Err() error  { return it.lister.Err() }
@@ -0,0 +1,70 @@
+// +build full
+
+package objectstore
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/FiloSottile/b2"
+)
+
+// TestB2StoreListFiltersPrefix guards against ListFiles/ListFilesVersions
+// not being a prefix filter: B2 just starts an alphabetically-sorted scan
+// from the given name, so List must filter (and stop on) names that don't
+// match prefix itself. "locks/" (used by Locker) sorts after most prefixes
+// used elsewhere in this repo (e.g. "caddytls/user/"), so a leftover lock
+// file is exactly the kind of key that would leak through unfiltered.
+func TestB2StoreListFiltersPrefix(t *testing.T) {
+	accountID := os.Getenv("B2_ACCOUNT_ID")
+	accountKey := os.Getenv("B2_ACCOUNT_KEY")
+	bucketID := os.Getenv("B2_BUCKET")
+	if accountID == "" || accountKey == "" || bucketID == "" {
+		t.Skip("B2_ACCOUNT_ID, B2_ACCOUNT_KEY and B2_BUCKET must be set")
+	}
+
+	client, err := b2.NewClient(accountID, accountKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewB2Store(client, bucketID)
+	ctx := context.Background()
+
+	const prefix = "test_list_prefix/user/"
+	keys := []string{
+		prefix + "alice",
+		prefix + "bob",
+		"test_list_prefix/zzz-not-a-user", // sorts after prefix, must not be listed
+	}
+
+	for _, key := range keys {
+		if err := store.Put(ctx, key, []byte("x"), "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, key := range keys {
+			store.Delete(ctx, key)
+		}
+	}()
+
+	var got []string
+	it := store.List(ctx, prefix)
+	for it.Next() {
+		got = append(got, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("List(%q) = %v, want exactly the 2 keys under the prefix", prefix, got)
+	}
+	for _, key := range got {
+		if key != prefix+"alice" && key != prefix+"bob" {
+			t.Fatalf("List(%q) returned out-of-prefix key %q", prefix, key)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package objectstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// EnvNameEncryptionKey is the name of the environment variable containing
+	// a base64-encoded 32-byte AES-256 key to use for client-side envelope
+	// encryption of stored secrets. If unset (and EnvNameEncryptionKeyFile is
+	// also unset), secrets are stored in plaintext.
+	EnvNameEncryptionKey = "B2_ENCRYPTION_KEY"
+
+	// EnvNameEncryptionKeyFile is the name of the environment variable
+	// containing the path to a file holding the base64-encoded key described
+	// by EnvNameEncryptionKey.
+	EnvNameEncryptionKeyFile = "B2_ENCRYPTION_KEY_FILE"
+)
+
+// EnvelopeVersion is the only envelope format currently understood.
+const EnvelopeVersion = 1
+
+// EnvelopeAlg identifies the AEAD used to seal the envelope.
+const EnvelopeAlg = "AES-256-GCM"
+
+// Envelope is the on-disk framing for an encrypted payload.
+type Envelope struct {
+	V     int    `json:"v"`
+	Alg   string `json:"alg"`
+	Nonce string `json:"nonce"`
+	CT    string `json:"ct"`
+}
+
+// LoadEncryptionKey reads the key-encryption-key from the environment, per
+// EnvNameEncryptionKey/EnvNameEncryptionKeyFile. It returns a nil key (and no
+// error) if neither variable is set, meaning encryption is disabled.
+func LoadEncryptionKey() ([]byte, error) {
+	raw := os.Getenv(EnvNameEncryptionKey)
+
+	if raw == "" {
+		path := os.Getenv(EnvNameEncryptionKeyFile)
+		if path == "" {
+			return nil, nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", EnvNameEncryptionKeyFile, err)
+		}
+
+		raw = string(data)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%s must be base64-encoded: %v", EnvNameEncryptionKey, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must decode to exactly 32 bytes, got %d", EnvNameEncryptionKey, len(key))
+	}
+
+	return key, nil
+}
+
+// EncryptEnvelope seals plaintext with key using AES-256-GCM and returns the
+// JSON-encoded envelope.
+func EncryptEnvelope(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ct := gcm.Seal(nil, nonce, plaintext, nil)
+
+	env := Envelope{
+		V:     EnvelopeVersion,
+		Alg:   EnvelopeAlg,
+		Nonce: base64.StdEncoding.EncodeToString(nonce),
+		CT:    base64.StdEncoding.EncodeToString(ct),
+	}
+
+	return json.Marshal(env)
+}
+
+// DecryptEnvelope opens an envelope produced by EncryptEnvelope.
+func DecryptEnvelope(key []byte, env Envelope) ([]byte, error) {
+	if env.Alg != EnvelopeAlg {
+		return nil, fmt.Errorf("unsupported envelope algorithm %q", env.Alg)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope nonce: %v", err)
+	}
+
+	ct, err := base64.StdEncoding.DecodeString(env.CT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope ciphertext: %v", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Open(nil, nonce, ct, nil)
+}
+
+// LooksLikeEnvelope reports whether data is plausibly a JSON-encoded
+// envelope, without fully validating it.
+func LooksLikeEnvelope(data []byte) (Envelope, bool) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Envelope{}, false
+	}
+	if env.V == 0 || env.Alg == "" || env.CT == "" {
+		return Envelope{}, false
+	}
+	return env, true
+}
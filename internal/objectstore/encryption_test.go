@@ -0,0 +1,77 @@
+package objectstore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptDecryptEnvelopeRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	plaintext := []byte(`{"cert":"hello","key":"world"}`)
+
+	sealed, err := EncryptEnvelope(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(sealed, plaintext) {
+		t.Fatalf("expected envelope to not contain the plaintext")
+	}
+
+	env, ok := LooksLikeEnvelope(sealed)
+	if !ok {
+		t.Fatalf("expected %s to look like an envelope", sealed)
+	}
+	if env.V != EnvelopeVersion {
+		t.Fatalf("expected version %d, got %d", EnvelopeVersion, env.V)
+	}
+	if env.Alg != EnvelopeAlg {
+		t.Fatalf("expected alg %q, got %q", EnvelopeAlg, env.Alg)
+	}
+
+	opened, err := DecryptEnvelope(key, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatalf("expected %q, got %q", plaintext, opened)
+	}
+}
+
+func TestDecryptEnvelopeWrongKey(t *testing.T) {
+	key := make([]byte, 32)
+	wrongKey := make([]byte, 32)
+	wrongKey[0] = 1
+
+	sealed, err := EncryptEnvelope(key, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, ok := LooksLikeEnvelope(sealed)
+	if !ok {
+		t.Fatal("expected envelope")
+	}
+
+	if _, err := DecryptEnvelope(wrongKey, env); err == nil {
+		t.Fatal("expected decryption with the wrong key to fail")
+	}
+}
+
+func TestLooksLikeEnvelope(t *testing.T) {
+	if _, ok := LooksLikeEnvelope([]byte(`{"cert":"plaintext"}`)); ok {
+		t.Fatal("expected a plain JSON payload to not look like an envelope")
+	}
+
+	sealed, err := EncryptEnvelope(make([]byte, 32), []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := LooksLikeEnvelope(sealed); !ok {
+		t.Fatal("expected a sealed envelope to look like an envelope")
+	}
+}
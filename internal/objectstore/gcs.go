@@ -0,0 +1,118 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsStore implements Store on top of a Google Cloud Storage bucket.
+// Credentials are read by the underlying client from
+// $GOOGLE_APPLICATION_CREDENTIALS, as usual for GCS client libraries.
+type gcsStore struct {
+	bucket *storage.BucketHandle
+}
+
+// NewGCSStore creates a Store backed by the given GCS bucket handle.
+func NewGCSStore(bucket *storage.BucketHandle) Store {
+	return &gcsStore{bucket: bucket}
+}
+
+func (s *gcsStore) object(key string) *storage.ObjectHandle {
+	return s.bucket.Object(key)
+}
+
+func (s *gcsStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return Retry(ctx, func() error {
+		w := s.object(key).NewWriter(ctx)
+		w.ContentType = contentType
+
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return err
+		}
+
+		return w.Close()
+	})
+}
+
+func (s *gcsStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+
+	err := Retry(ctx, func() error {
+		rd, err := s.object(key).NewReader(ctx)
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				return ErrNotExist
+			}
+			return err
+		}
+		defer rd.Close()
+
+		data, err = ioutil.ReadAll(rd)
+		return err
+	})
+
+	return data, err
+}
+
+func (s *gcsStore) Delete(ctx context.Context, key string) error {
+	return Retry(ctx, func() error {
+		err := s.object(key).Delete(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return ErrNotExist
+		}
+		return err
+	})
+}
+
+func (s *gcsStore) Stat(ctx context.Context, key string) (Info, error) {
+	var info Info
+
+	err := Retry(ctx, func() error {
+		attrs, err := s.object(key).Attrs(ctx)
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				return ErrNotExist
+			}
+			return err
+		}
+
+		info = Info{Key: attrs.Name, Size: attrs.Size, ModTime: attrs.Updated}
+		return nil
+	})
+
+	return info, err
+}
+
+func (s *gcsStore) List(ctx context.Context, prefix string) Iterator {
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	return &gcsIterator{it: it}
+}
+
+type gcsIterator struct {
+	it   *storage.ObjectIterator
+	info Info
+	err  error
+}
+
+func (it *gcsIterator) Next() bool {
+	attrs, err := it.it.Next()
+	if err == iterator.Done {
+		return false
+	}
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.info = Info{Key: attrs.Name, Size: attrs.Size, ModTime: attrs.Updated}
+	return true
+}
+
+func (it *gcsIterator) Key() string { return it.info.Key }
+func (it *gcsIterator) Info() Info  { return it.info }
+func (it *gcsIterator) Err() error  { return it.err }
@@ -0,0 +1,377 @@
+package objectstore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// DefaultLockTTL is how long a lock file may stay unrefreshed before another
+// acquirer is allowed to consider it stale and break it.
+const DefaultLockTTL = 1 * time.Minute
+
+// lockPollInterval is how often a Waiter polls the store for the current
+// lock holder to disappear.
+const lockPollInterval = 500 * time.Millisecond
+
+// Waiter is returned by Locker.TryLock when the lock is already held. Its
+// shape matches caddytls.Waiter so callers can return it directly.
+type Waiter interface {
+	Wait()
+}
+
+// lockBody is the JSON document written as the content of a lock object. It
+// records who is holding (or was holding) the lock, so that breaking a
+// stale lock can be logged with some useful context.
+type lockBody struct {
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Nonce     string    `json:"nonce"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Version describes one live version of an object, as returned by a
+// VersionedStore, oldest first.
+type Version struct {
+	ID      string
+	ModTime time.Time
+}
+
+// VersionedStore is implemented by backends that keep multiple live
+// versions of the same key around and can enumerate/delete them
+// individually (B2 does this natively). When the Store passed to NewLocker
+// also implements VersionedStore, Locker uses the race-free algorithm
+// described by request #1: write a new version, then list versions for the
+// key; whoever's version is the oldest live one holds the lock, so there is
+// no window where two acquirers can both believe they hold it. Stores that
+// can't enumerate versions (GCS, plain S3 without bucket versioning) fall
+// back to a best-effort "write if absent" check, which has a narrower but
+// real race: two acquirers can both observe the lock as free and both
+// write, with the later write winning.
+type VersionedStore interface {
+	Store
+
+	// PutVersion writes data as a new version of key, returning an
+	// identifier for that version suitable for later comparison or
+	// DeleteVersion.
+	PutVersion(ctx context.Context, key string, data []byte, contentType string) (id string, err error)
+
+	// ListVersions returns every live version of key, in any order.
+	ListVersions(ctx context.Context, key string) ([]Version, error)
+
+	// GetVersion returns the content of the specific version id of key.
+	GetVersion(ctx context.Context, key string, id string) ([]byte, error)
+
+	// DeleteVersion deletes the specific version id of key.
+	DeleteVersion(ctx context.Context, key string, id string) error
+}
+
+// Locker implements a distributed lock on top of any Store: the holder
+// writes a lock object containing its identity and a timestamp. When the
+// store is a VersionedStore, acquiring is race-free (see VersionedStore);
+// otherwise it degrades to a best-effort write-if-absent check.
+type Locker struct {
+	store Store
+	ttl   time.Duration
+}
+
+// NewLocker creates a Locker backed by store, breaking locks older than ttl.
+// If ttl is zero, DefaultLockTTL is used.
+func NewLocker(store Store, ttl time.Duration) *Locker {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+	return &Locker{store: store, ttl: ttl}
+}
+
+func lockPath(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "locks/" + hex.EncodeToString(sum[:]) + ".lock"
+}
+
+func identity() (host string, pid int, nonce string, err error) {
+	host, err = os.Hostname()
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", 0, "", err
+	}
+
+	return host, os.Getpid(), hex.EncodeToString(buf[:]), nil
+}
+
+// TryLock tries to acquire the lock for name. If it is already held by
+// someone else (and not stale), it returns a Waiter the caller can Wait()
+// on, then retry TryLock.
+func (l *Locker) TryLock(ctx context.Context, name string) (Waiter, error) {
+	path := lockPath(name)
+
+	host, pid, nonce, err := identity()
+	if err != nil {
+		return nil, err
+	}
+
+	if vs, ok := l.store.(VersionedStore); ok {
+		return l.tryLockVersioned(ctx, vs, path, name, host, pid, nonce)
+	}
+	return l.tryLockBestEffort(ctx, path, name, host, pid, nonce)
+}
+
+// tryLockVersioned is the race-free algorithm: write a new version of the
+// lock object, then list versions. We hold the lock iff our version is the
+// oldest live one; otherwise we delete our version (and the current
+// holder's, if stale) and return a Waiter for the holder we observed.
+func (l *Locker) tryLockVersioned(ctx context.Context, vs VersionedStore, path, name, host string, pid int, nonce string) (Waiter, error) {
+	body := lockBody{Host: host, PID: pid, Nonce: nonce, Timestamp: time.Now()}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := vs.PutVersion(ctx, path, data, "application/json")
+	if err != nil {
+		return nil, fmt.Errorf("objectstore: TryLock(%q): %v", name, err)
+	}
+
+	versions, err := vs.ListVersions(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("objectstore: TryLock(%q): %v", name, err)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("objectstore: TryLock(%q): no versions found for %q right after writing one", name, path)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ModTime.Before(versions[j].ModTime)
+	})
+
+	oldest := versions[0]
+	if oldest.ID == id {
+		// We're the oldest live version: we hold the lock.
+		return nil, nil
+	}
+
+	// Someone else holds the lock. If their version is older than the TTL,
+	// break it so whoever retries next can succeed immediately.
+	if time.Since(oldest.ModTime) > l.ttl {
+		log.Printf("objectstore: breaking stale lock %q held by %s (version %s, %s old)", name, describeHolder(ctx, vs, path, oldest.ID), oldest.ID, time.Since(oldest.ModTime))
+		if err := vs.DeleteVersion(ctx, path, oldest.ID); err != nil {
+			log.Printf("objectstore: TryLock(%q): deleting stale version %s: %v", name, oldest.ID, err)
+		} else {
+			// With the stale version gone, our own version may now be the
+			// oldest live one. Re-check instead of unconditionally falling
+			// back to delete-self-and-wait, so breaking a stale lock can
+			// result in immediate acquisition.
+			remaining, err := vs.ListVersions(ctx, path)
+			if err != nil {
+				return nil, fmt.Errorf("objectstore: TryLock(%q): %v", name, err)
+			}
+			if len(remaining) == 0 {
+				return nil, fmt.Errorf("objectstore: TryLock(%q): no versions found for %q right after breaking a stale one", name, path)
+			}
+
+			sort.Slice(remaining, func(i, j int) bool {
+				return remaining[i].ModTime.Before(remaining[j].ModTime)
+			})
+
+			if remaining[0].ID == id {
+				return nil, nil
+			}
+			oldest = remaining[0]
+		}
+	}
+
+	if err := vs.DeleteVersion(ctx, path, id); err != nil {
+		return nil, fmt.Errorf("objectstore: TryLock(%q): %v", name, err)
+	}
+
+	return &versionedWaiter{store: vs, path: path, holder: oldest.ID}, nil
+}
+
+// describeHolder fetches and unmarshals the lock body of version id so a
+// stale-break log line can name who actually held it, instead of just the
+// opaque version ID. Any error fetching or decoding it is folded into the
+// returned description rather than propagated, since this is only used for
+// logging.
+func describeHolder(ctx context.Context, vs VersionedStore, path, id string) string {
+	data, err := vs.GetVersion(ctx, path, id)
+	if err != nil {
+		return fmt.Sprintf("unknown (fetching holder: %v)", err)
+	}
+
+	var body lockBody
+	if err := json.Unmarshal(data, &body); err != nil {
+		return fmt.Sprintf("unknown (decoding holder: %v)", err)
+	}
+
+	return fmt.Sprintf("%s@%d", body.Host, body.PID)
+}
+
+// tryLockBestEffort is used for stores that can't enumerate versions: it
+// writes the lock object only if none exists yet (or the existing one is
+// stale). Two acquirers can both observe the lock as free and both write,
+// with the later write winning; this is deemed acceptable for backends that
+// offer no stronger primitive.
+func (l *Locker) tryLockBestEffort(ctx context.Context, path, name, host string, pid int, nonce string) (Waiter, error) {
+	existing, err := l.store.Get(ctx, path)
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		return nil, fmt.Errorf("objectstore: TryLock(%q): %v", name, err)
+	}
+
+	if err == nil {
+		var body lockBody
+		if err := json.Unmarshal(existing, &body); err != nil {
+			return nil, fmt.Errorf("objectstore: TryLock(%q): invalid lock body: %v", name, err)
+		}
+
+		if time.Since(body.Timestamp) <= l.ttl {
+			return &waiter{store: l.store, path: path}, nil
+		}
+
+		// Stale: fall through and steal it.
+		log.Printf("objectstore: stealing stale lock %q held by %s@%d, %s old", name, body.Host, body.PID, time.Since(body.Timestamp))
+	}
+
+	body := lockBody{Host: host, PID: pid, Nonce: nonce, Timestamp: time.Now()}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.store.Put(ctx, path, data, "application/json"); err != nil {
+		return nil, fmt.Errorf("objectstore: TryLock(%q): %v", name, err)
+	}
+
+	return nil, nil
+}
+
+// Unlock releases the lock for name by deleting our own lock object,
+// provided it is still ours.
+func (l *Locker) Unlock(ctx context.Context, name string) error {
+	path := lockPath(name)
+
+	host, pid, _, err := identity()
+	if err != nil {
+		return err
+	}
+
+	if vs, ok := l.store.(VersionedStore); ok {
+		return l.unlockVersioned(ctx, vs, path, name, host, pid)
+	}
+	return l.unlockBestEffort(ctx, path, name, host, pid)
+}
+
+func (l *Locker) unlockVersioned(ctx context.Context, vs VersionedStore, path, name, host string, pid int) error {
+	versions, err := vs.ListVersions(ctx, path)
+	if err != nil {
+		return fmt.Errorf("objectstore: Unlock(%q): %v", name, err)
+	}
+
+	for _, v := range versions {
+		data, err := vs.GetVersion(ctx, path, v.ID)
+		if err != nil {
+			continue
+		}
+
+		var body lockBody
+		if err := json.Unmarshal(data, &body); err != nil {
+			continue
+		}
+
+		if body.Host == host && body.PID == pid {
+			if err := vs.DeleteVersion(ctx, path, v.ID); err != nil {
+				return fmt.Errorf("objectstore: Unlock(%q): %v", name, err)
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (l *Locker) unlockBestEffort(ctx context.Context, path, name, host string, pid int) error {
+	existing, err := l.store.Get(ctx, path)
+	if err != nil {
+		if errors.Is(err, ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("objectstore: Unlock(%q): %v", name, err)
+	}
+
+	var body lockBody
+	if err := json.Unmarshal(existing, &body); err != nil {
+		return fmt.Errorf("objectstore: Unlock(%q): invalid lock body: %v", name, err)
+	}
+	if body.Host != host || body.PID != pid {
+		// Not ours (anymore); nothing to do.
+		return nil
+	}
+
+	if err := l.store.Delete(ctx, path); err != nil {
+		return fmt.Errorf("objectstore: Unlock(%q): %v", name, err)
+	}
+
+	return nil
+}
+
+// waiter polls the store until the lock at path is gone. Used for
+// best-effort (non-versioned) locking.
+type waiter struct {
+	store Store
+	path  string
+}
+
+func (w *waiter) Wait() {
+	for {
+		time.Sleep(lockPollInterval)
+
+		_, err := w.store.Get(context.Background(), w.path)
+		if errors.Is(err, ErrNotExist) {
+			return
+		}
+	}
+}
+
+// versionedWaiter polls a VersionedStore until the specific version it
+// observed as the lock holder is gone, i.e. until that holder releases (or
+// is broken free of) the lock.
+type versionedWaiter struct {
+	store  VersionedStore
+	path   string
+	holder string
+}
+
+func (w *versionedWaiter) Wait() {
+	for {
+		time.Sleep(lockPollInterval)
+
+		versions, err := w.store.ListVersions(context.Background(), w.path)
+		if err != nil {
+			continue
+		}
+
+		var stillHeld bool
+		for _, v := range versions {
+			if v.ID == w.holder {
+				stillHeld = true
+				break
+			}
+		}
+		if !stillHeld {
+			return
+		}
+	}
+}
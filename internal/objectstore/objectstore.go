@@ -0,0 +1,51 @@
+// Package objectstore defines a small cloud-object-storage abstraction
+// shared by tlsb2's backends (B2, GCS, S3). It exists because most of what
+// tlsb2 needs from a cloud provider isn't provider-specific: a retry loop
+// around uploads, JSON marshaling, a file layout, distributed locking and
+// optional client-side encryption. Only Store itself has a different
+// implementation per provider.
+package objectstore // import "rischmann.fr/caddy-tlsb2/internal/objectstore"
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotExist is returned by Get/Stat/Delete when the key does not exist.
+// Implementations should wrap their provider-specific not-found error so
+// that errors.Is(err, ErrNotExist) works.
+var ErrNotExist = errors.New("objectstore: key does not exist")
+
+// Info describes an object in the store.
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Iterator lists keys under a prefix, oldest usage first.
+//
+//	for it.Next() {
+//	    key := it.Key()
+//	}
+//	if err := it.Err(); err != nil {
+//	    ...
+//	}
+type Iterator interface {
+	Next() bool
+	Key() string
+	Info() Info
+	Err() error
+}
+
+// Store is the minimal interface a cloud-object backend must implement.
+// Everything else tlsb2 needs (locking, retries, encryption) is built on
+// top of it in this package.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (Info, error)
+	List(ctx context.Context, prefix string) Iterator
+}
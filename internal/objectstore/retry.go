@@ -0,0 +1,168 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/FiloSottile/b2"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"google.golang.org/api/googleapi"
+)
+
+// maxRetries is how many times Retry will call fn before giving up.
+const maxRetries = 5
+
+// baseDelay and maxDelay bound the exponential backoff between attempts:
+// the nth retry waits min(maxDelay, baseDelay*2^n), before jitter.
+const (
+	baseDelay = 200 * time.Millisecond
+	maxDelay  = 10 * time.Second
+)
+
+// jitterFraction is how much of the computed backoff is randomized, as a
+// fraction of the delay, so that multiple clients retrying at once don't
+// all wake up in lockstep.
+const jitterFraction = 0.5
+
+// Retry calls fn until it succeeds, ctx is done, fn returns an error that
+// isn't worth retrying, or maxRetries is reached, whichever comes first. It
+// exists so every Store implementation shares the same retry policy instead
+// of rolling its own loop.
+func Retry(ctx context.Context, fn func() error) error {
+	var err error
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		if attempt == maxRetries-1 {
+			break
+		}
+
+		delay := backoff(attempt)
+		if d, ok := retryAfter(err); ok {
+			delay = d
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	return err
+}
+
+// backoff returns the delay before the retry following attempt: an
+// exponentially growing base capped at maxDelay, with up to ±jitterFraction
+// of random jitter applied on top.
+func backoff(attempt int) time.Duration {
+	d := baseDelay * time.Duration(1<<uint(attempt))
+	if d <= 0 || d > maxDelay {
+		d = maxDelay
+	}
+
+	jitter := time.Duration(float64(d) * jitterFraction * (2*rand.Float64() - 1))
+	d += jitter
+	if d < 0 {
+		d = 0
+	}
+
+	return d
+}
+
+// isRetryable reports whether err is worth retrying. An HTTP status of 408
+// (timeout), 429 (rate limited) or 5xx is retried; 400/401/403/404 is never
+// retried, since those mean the request itself needs to change, not just be
+// resent. This applies uniformly across backends: a *b2.Error for B2, a
+// *googleapi.Error for GCS, and a *smithyhttp.ResponseError for S3 (the AWS
+// SDK v2's carrier of the underlying HTTP status). Anything else (network
+// errors from any of the three clients, unrecognized status codes) is
+// retried by default, except for the sentinel errors below that are never
+// worth retrying.
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrNotExist) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if v, ok := b2.UnwrapError(err); ok {
+		return isRetryableStatus(v.Status)
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return isRetryableStatus(gerr.Code)
+	}
+
+	var rerr *smithyhttp.ResponseError
+	if errors.As(err, &rerr) {
+		return isRetryableStatus(rerr.HTTPStatusCode())
+	}
+
+	return true
+}
+
+// isRetryableStatus classifies an HTTP status code as retryable or not,
+// shared by every backend's error classification above.
+func isRetryableStatus(status int) bool {
+	switch status {
+	case 408, 429, 500, 502, 503, 504:
+		return true
+	case 400, 401, 403, 404:
+		return false
+	default:
+		return status >= 500
+	}
+}
+
+// retryAfter reports the server-requested retry delay parsed from err's
+// Retry-After header, if any. Only *googleapi.Error (GCS) and
+// *smithyhttp.ResponseError (S3) carry a response with headers; *b2.Error
+// (B2) doesn't expose one at all, so B2 errors always fall back to the
+// computed backoff.
+func retryAfter(err error) (time.Duration, bool) {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return parseRetryAfter(gerr.Header)
+	}
+
+	var rerr *smithyhttp.ResponseError
+	if errors.As(err, &rerr) {
+		return parseRetryAfter(rerr.Response.Header)
+	}
+
+	return 0, false
+}
+
+// parseRetryAfter parses a Retry-After header, which per RFC 7231 is either
+// a number of seconds or an HTTP date.
+func parseRetryAfter(h http.Header) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,184 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/FiloSottile/b2"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryableB2Status(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{408, true},
+		{429, true},
+		{500, true},
+		{502, true},
+		{503, true},
+		{504, true},
+		{400, false},
+		{401, false},
+		{403, false},
+		{404, false},
+	}
+
+	for _, tt := range tests {
+		err := &b2.Error{Status: tt.status}
+		if got := isRetryable(err); got != tt.want {
+			t.Errorf("isRetryable(b2.Error{Status: %d}) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestIsRetryableGCSStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{408, true},
+		{429, true},
+		{500, true},
+		{400, false},
+		{401, false},
+		{403, false},
+		{404, false},
+	}
+
+	for _, tt := range tests {
+		err := &googleapi.Error{Code: tt.status}
+		if got := isRetryable(err); got != tt.want {
+			t.Errorf("isRetryable(googleapi.Error{Code: %d}) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestIsRetryableS3Status(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{429, true},
+		{500, true},
+		{400, false},
+		{403, false},
+		{404, false},
+	}
+
+	for _, tt := range tests {
+		err := &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: tt.status}},
+		}
+		if got := isRetryable(err); got != tt.want {
+			t.Errorf("isRetryable(ResponseError{StatusCode: %d}) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestIsRetryableSentinels(t *testing.T) {
+	if isRetryable(ErrNotExist) {
+		t.Error("ErrNotExist should not be retryable")
+	}
+	if isRetryable(context.Canceled) {
+		t.Error("context.Canceled should not be retryable")
+	}
+	if isRetryable(context.DeadlineExceeded) {
+		t.Error("context.DeadlineExceeded should not be retryable")
+	}
+	if !isRetryable(errors.New("connection reset by peer")) {
+		t.Error("an unrecognized (e.g. network) error should be retryable by default")
+	}
+}
+
+func TestRetryStopsOnNonRetryableError(t *testing.T) {
+	var calls int
+	err := Retry(context.Background(), func() error {
+		calls++
+		return ErrNotExist
+	})
+
+	if !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected fn to be called once, got %d", calls)
+	}
+}
+
+func TestRetryStopsOnContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var calls int
+	err := Retry(ctx, func() error {
+		calls++
+		return &b2.Error{Status: 429}
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected fn to be called once before the context was observed as done, got %d", calls)
+	}
+}
+
+func TestRetryAfterGCS(t *testing.T) {
+	err := &googleapi.Error{Code: 429, Header: http.Header{"Retry-After": []string{"2"}}}
+
+	d, ok := retryAfter(err)
+	if !ok {
+		t.Fatal("expected a Retry-After delay")
+	}
+	if d != 2*time.Second {
+		t.Fatalf("expected 2s, got %s", d)
+	}
+}
+
+func TestRetryAfterS3(t *testing.T) {
+	err := &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{
+			Response: &http.Response{StatusCode: 429, Header: http.Header{"Retry-After": []string{"3"}}},
+		},
+	}
+
+	d, ok := retryAfter(err)
+	if !ok {
+		t.Fatal("expected a Retry-After delay")
+	}
+	if d != 3*time.Second {
+		t.Fatalf("expected 3s, got %s", d)
+	}
+}
+
+func TestRetryAfterB2Absent(t *testing.T) {
+	// b2.Error carries no response headers, so there's never a Retry-After
+	// to honor; the computed backoff is used instead.
+	if _, ok := retryAfter(&b2.Error{Status: 429}); ok {
+		t.Error("expected no Retry-After delay for a b2.Error")
+	}
+}
+
+func TestRetrySucceedsAfterRetryableErrors(t *testing.T) {
+	var calls int
+	err := Retry(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return &b2.Error{Status: 500}
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
@@ -0,0 +1,177 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Store implements Store on top of an S3 (or S3-compatible, e.g. MinIO)
+// bucket. Credentials come from the SDK's default provider chain.
+type s3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+// NewS3Store creates a Store backed by the given S3 bucket, using client
+// for API calls. client's endpoint can be overridden for MinIO
+// compatibility by configuring it via s3.Options when constructing client.
+func NewS3Store(client *s3.Client, bucket string) Store {
+	return &s3Store{client: client, bucket: bucket}
+}
+
+// isS3NotFound reports whether err indicates the object doesn't exist.
+// GetObject/DeleteObject return *types.NoSuchKey, but HeadObject (used by
+// Stat) has no body to parse a specific error code from and returns the
+// more generic *types.NotFound instead, so both are checked.
+func isS3NotFound(err error) bool {
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return true
+	}
+	var nf *types.NotFound
+	return errors.As(err, &nf)
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return Retry(ctx, func() error {
+		_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String(contentType),
+		})
+		return err
+	})
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+
+	err := Retry(ctx, func() error {
+		out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if isS3NotFound(err) {
+				return ErrNotExist
+			}
+			return err
+		}
+		defer out.Body.Close()
+
+		data, err = ioutil.ReadAll(out.Body)
+		return err
+	})
+
+	return data, err
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	return Retry(ctx, func() error {
+		_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+}
+
+func (s *s3Store) Stat(ctx context.Context, key string) (Info, error) {
+	var info Info
+
+	err := Retry(ctx, func() error {
+		out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if isS3NotFound(err) {
+				return ErrNotExist
+			}
+			return err
+		}
+
+		info = Info{Key: key, Size: out.ContentLength, ModTime: aws.ToTime(out.LastModified)}
+		return nil
+	})
+
+	return info, err
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) Iterator {
+	return &s3Iterator{
+		ctx:    ctx,
+		client: s.client,
+		bucket: s.bucket,
+		prefix: prefix,
+	}
+}
+
+// s3Iterator pages through ListObjectsV2, fetching a new page each time the
+// current one is exhausted.
+type s3Iterator struct {
+	ctx    context.Context
+	client *s3.Client
+	bucket string
+	prefix string
+
+	token   *string
+	objects []types.Object
+	idx     int
+	done    bool
+	err     error
+	info    Info
+}
+
+func (it *s3Iterator) Next() bool {
+	if it.err != nil || it.done {
+		return false
+	}
+
+	for it.idx >= len(it.objects) {
+		if it.token == nil && it.objects != nil {
+			// We've already fetched at least one page and there's no more.
+			it.done = true
+			return false
+		}
+
+		out, err := it.client.ListObjectsV2(it.ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(it.bucket),
+			Prefix:            aws.String(it.prefix),
+			ContinuationToken: it.token,
+		})
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.objects = out.Contents
+		it.idx = 0
+		it.token = out.NextContinuationToken
+
+		if len(it.objects) == 0 {
+			if it.token == nil {
+				it.done = true
+				return false
+			}
+		}
+	}
+
+	obj := it.objects[it.idx]
+	it.idx++
+
+	it.info = Info{Key: aws.ToString(obj.Key), Size: obj.Size, ModTime: aws.ToTime(obj.LastModified)}
+
+	return true
+}
+
+func (it *s3Iterator) Key() string { return it.info.Key }
+func (it *s3Iterator) Info() Info  { return it.info }
+func (it *s3Iterator) Err() error  { return it.err }
@@ -0,0 +1,74 @@
+package tlsb2 // import "rischmann.fr/caddy-tlsb2"
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/mholt/caddy/caddytls"
+
+	"rischmann.fr/caddy-tlsb2/internal/objectstore"
+)
+
+// MigrateEncrypt rewrites every site and user object in s's bucket so that
+// it is sealed in an encryption envelope, using s's configured encryption
+// key. Objects that are already encrypted are left untouched, so this is
+// safe to run more than once or on a bucket that's a mix of encrypted and
+// plaintext objects. It returns the number of objects it rewrote.
+//
+// s must have been created with an encryption key configured (see
+// internal/objectstore.LoadEncryptionKey); MigrateEncrypt has nothing to
+// encrypt with otherwise. s can be any of NewB2Storage, NewGCSStorage or
+// NewS3Storage's return value.
+func MigrateEncrypt(s caddytls.Storage) (int, error) {
+	sb, ok := s.(storageBackend)
+	if !ok {
+		return 0, errors.New("tlsb2: MigrateEncrypt does not support this Storage implementation")
+	}
+
+	cs := sb.backend()
+	if cs.encryptionKey == nil {
+		return 0, errors.New("tlsb2: no encryption key configured; set B2_ENCRYPTION_KEY or B2_ENCRYPTION_KEY_FILE first")
+	}
+
+	ctx := context.Background()
+
+	domainPrefix := mkDomainPath("")
+	userPrefix := mkUserPath("")
+
+	var migrated int
+
+	it := cs.store.List(ctx, mkpath(""))
+	for it.Next() {
+		key := it.Key()
+
+		if !strings.HasPrefix(key, domainPrefix) && !strings.HasPrefix(key, userPrefix) {
+			continue
+		}
+
+		data, err := cs.store.Get(ctx, key)
+		if err != nil {
+			return migrated, &Error{op: "MigrateEncrypt/Get", err: err}
+		}
+
+		if _, already := objectstore.LooksLikeEnvelope(data); already {
+			continue
+		}
+
+		sealed, err := objectstore.EncryptEnvelope(cs.encryptionKey, data)
+		if err != nil {
+			return migrated, &Error{op: "MigrateEncrypt/Encrypt", err: err}
+		}
+
+		if err := cs.store.Put(ctx, key, sealed, ""); err != nil {
+			return migrated, &Error{op: "MigrateEncrypt/Put", err: err}
+		}
+
+		migrated++
+	}
+	if err := it.Err(); err != nil {
+		return migrated, &Error{op: "MigrateEncrypt/List", err: err}
+	}
+
+	return migrated, nil
+}
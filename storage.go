@@ -1,25 +1,29 @@
 package tlsb2 // import "rischmann.fr/caddy-tlsb2"
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"sort"
-	"sync"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/FiloSottile/b2"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/mholt/caddy/caddytls"
+
+	"rischmann.fr/caddy-tlsb2/internal/objectstore"
 )
 
 func init() {
 	caddytls.RegisterStorageProvider("b2", NewB2Storage)
+	caddytls.RegisterStorageProvider("gcs", NewGCSStorage)
+	caddytls.RegisterStorageProvider("s3", NewS3Storage)
 }
 
 const (
@@ -31,14 +35,103 @@ const (
 
 	// EnvNameBucket is the bucket containing the files.
 	EnvNameBucket = "B2_BUCKET"
+
+	// EnvNameLockTTL is the name of the environment variable containing the
+	// lock TTL as a duration string (e.g. "90s"). If unset,
+	// objectstore.DefaultLockTTL is used.
+	EnvNameLockTTL = "B2_LOCK_TTL"
+
+	// EnvNameGCSBucket is the name of the environment variable containing
+	// the GCS bucket name. Credentials are read from
+	// $GOOGLE_APPLICATION_CREDENTIALS, per the usual GCS client conventions.
+	EnvNameGCSBucket = "GCS_BUCKET"
+
+	// EnvNameS3Bucket is the name of the environment variable containing the
+	// S3 bucket name. Credentials are read from the AWS SDK's default
+	// provider chain.
+	EnvNameS3Bucket = "S3_BUCKET"
+
+	// EnvNameS3Endpoint is the name of the environment variable containing
+	// an alternate S3 endpoint URL, for MinIO (or other S3-compatible
+	// services) compatibility. Optional; the AWS default endpoint is used
+	// if unset.
+	EnvNameS3Endpoint = "S3_ENDPOINT"
 )
 
+var debug = os.Getenv("B2_DEBUG") == "1"
+
+func debugf(format string, args ...interface{}) {
+	if debug {
+		log.Printf("[tlsb2] "+format, args...)
+	}
+}
+
+func lockTTLFromEnv() (time.Duration, error) {
+	v := os.Getenv(EnvNameLockTTL)
+	if v == "" {
+		return objectstore.DefaultLockTTL, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", EnvNameLockTTL, err)
+	}
+	return d, nil
+}
+
+// cloudStorage implements caddytls.Storage on top of any objectstore.Store,
+// giving every backend (B2, GCS, S3) the same JSON layout, locking and
+// optional client-side encryption for free.
+type cloudStorage struct {
+	store   objectstore.Store
+	locker  *objectstore.Locker
+	backend string // for error messages, e.g. "b2", "gcs", "s3"
+
+	// encryptionKey, if non-nil, is the 32-byte AES-256 key used to envelope
+	// secrets written by StoreSite/StoreUser. See
+	// internal/objectstore/encryption.go.
+	encryptionKey []byte
+}
+
+// b2Storage implements the legacy caddytls.Storage interface on top of B2.
+//
+// Deprecated: caddytls.Storage has been superseded upstream by certmagic's
+// key/value Storage interface. New code should use
+// rischmann.fr/caddy-tlsb2/certmagicstorage instead.
+type b2Storage struct {
+	cloudStorage
+}
+
+// gcsStorage implements caddytls.Storage on top of Google Cloud Storage.
+type gcsStorage struct {
+	cloudStorage
+}
+
+// s3Storage implements caddytls.Storage on top of S3 (or an S3-compatible
+// service, e.g. MinIO).
+type s3Storage struct {
+	cloudStorage
+}
+
+// backend returns the cloudStorage embedded in s; it lets code generic over
+// all three concrete types (e.g. MigrateEncrypt) reach the shared internals.
+type storageBackend interface {
+	backend() *cloudStorage
+}
+
+func (s *b2Storage) backend() *cloudStorage  { return &s.cloudStorage }
+func (s *gcsStorage) backend() *cloudStorage { return &s.cloudStorage }
+func (s *s3Storage) backend() *cloudStorage  { return &s.cloudStorage }
+
 // NewB2Storage creates a new caddytls.Storage for the given Certificate Authority URL.
 //
 // Credentials for b2 are read from environment variables.
 // See the constants to know their names and uses.
 //
-// NOTE: the Locker implemented by this storage is local only right now.
+// Locking, retries and optional client-side encryption are shared with the
+// gcs and s3 backends; see internal/objectstore.
+//
+// Deprecated: see b2Storage.
 func NewB2Storage(caURL *url.URL) (caddytls.Storage, error) {
 	accountID := os.Getenv(EnvNameAccountID)
 	if accountID == "" {
@@ -60,244 +153,439 @@ func NewB2Storage(caURL *url.URL) (caddytls.Storage, error) {
 		return nil, err
 	}
 
-	return &b2Storage{
-		bucketID: bucketID,
-		client:   client,
-		waiters:  newWaiters(),
-	}, nil
+	cs, err := newCloudStorage("b2", objectstore.NewB2Store(client, bucketID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &b2Storage{cloudStorage: *cs}, nil
 }
 
-var debug = os.Getenv("B2_DEBUG") == "1"
+// NewGCSStorage creates a new caddytls.Storage backed by Google Cloud
+// Storage for the given Certificate Authority URL. The bucket name is read
+// from $GCS_BUCKET; credentials are read from
+// $GOOGLE_APPLICATION_CREDENTIALS, per the usual GCS client conventions.
+func NewGCSStorage(caURL *url.URL) (caddytls.Storage, error) {
+	bucketName := os.Getenv(EnvNameGCSBucket)
+	if bucketName == "" {
+		return nil, fmt.Errorf("no bucket set, please set $%s", EnvNameGCSBucket)
+	}
 
-func debugf(format string, args ...interface{}) {
-	if debug {
-		log.Printf("[tlsb2] "+format, args...)
+	ctx := context.Background()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
 	}
+
+	cs, err := newCloudStorage("gcs", objectstore.NewGCSStore(client.Bucket(bucketName)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcsStorage{cloudStorage: *cs}, nil
 }
 
-type b2Storage struct {
-	bucketID string
-	client   *b2.Client
-	waiters  *waiters
+// NewS3Storage creates a new caddytls.Storage backed by S3 (or an
+// S3-compatible service, e.g. MinIO) for the given Certificate Authority
+// URL. The bucket name is read from $S3_BUCKET; credentials come from the
+// AWS SDK's default provider chain. $S3_ENDPOINT can override the endpoint
+// for MinIO compatibility.
+func NewS3Storage(caURL *url.URL) (caddytls.Storage, error) {
+	bucketName := os.Getenv(EnvNameS3Bucket)
+	if bucketName == "" {
+		return nil, fmt.Errorf("no bucket set, please set $%s", EnvNameS3Bucket)
+	}
+
+	ctx := context.Background()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint := os.Getenv(EnvNameS3Endpoint); endpoint != "" {
+			o.BaseEndpoint = &endpoint
+		}
+	})
+
+	cs, err := newCloudStorage("s3", objectstore.NewS3Store(client, bucketName))
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Storage{cloudStorage: *cs}, nil
 }
 
-func (s *b2Storage) withBucket(op string, fn func(bucket *b2.Bucket) error) error {
-	bucket := s.client.BucketByID(s.bucketID)
-	return fn(bucket)
+func newCloudStorage(backend string, store objectstore.Store) (*cloudStorage, error) {
+	lockTTL, err := lockTTLFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	encryptionKey, err := objectstore.LoadEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &cloudStorage{
+		store:         store,
+		locker:        objectstore.NewLocker(store, lockTTL),
+		backend:       backend,
+		encryptionKey: encryptionKey,
+	}, nil
 }
 
-func (s *b2Storage) fetchName(op string, name string, p interface{}) error {
-	return s.withBucket(op, func(b *b2.Bucket) error {
-		fi, err := b.GetFileInfoByName(name)
-		if err != nil {
-			return &Error{op: op + "/GetFileInfoByName", err: err}
+// fetchName downloads name and decodes it as JSON into p. If the stored
+// payload is an encryption envelope, it is transparently decrypted first;
+// unencrypted payloads are decoded as-is, so buckets written before an
+// encryption key was configured keep loading.
+func (s *cloudStorage) fetchName(ctx context.Context, op string, name string, p interface{}) error {
+	data, err := s.store.Get(ctx, name)
+	if err != nil {
+		return &Error{op: op + "/Get", err: err}
+	}
+
+	if env, ok := objectstore.LooksLikeEnvelope(data); ok {
+		if s.encryptionKey == nil {
+			return &Error{op: op, err: errors.New("payload is encrypted but no encryption key is configured")}
 		}
 
-		rd, _, err := s.client.DownloadFileByID(fi.ID)
+		data, err = objectstore.DecryptEnvelope(s.encryptionKey, env)
 		if err != nil {
-			return &Error{op: op + "/DownloadFileByID", err: err}
+			return &Error{op: op + "/Decrypt", err: err}
 		}
-		defer rd.Close()
+	}
 
-		dec := json.NewDecoder(rd)
-		if err := dec.Decode(p); err != nil {
-			return &Error{op: op + "/Unmarshal", err: err}
-		}
+	if err := json.Unmarshal(data, p); err != nil {
+		return &Error{op: op + "/Unmarshal", err: err}
+	}
 
-		return nil
-	})
+	return nil
+}
+
+// storeName JSON-encodes d and writes it at name. If s.encryptionKey is
+// configured, the JSON is sealed into an encryption envelope first.
+func (s *cloudStorage) storeName(ctx context.Context, op string, name string, d interface{}) error {
+	buf, err := s.marshalTLSData(d)
+	if err != nil {
+		return &Error{op: op + "/Marshal", err: err}
+	}
+
+	if err := s.store.Put(ctx, name, buf, ""); err != nil {
+		return &Error{op: op + "/Put", err: err}
+	}
+
+	return nil
 }
 
-func isNotFound(err error) bool {
-	v, ok := b2.UnwrapError(err)
-	if !ok {
-		return false
+// marshalTLSData JSON-encodes d. If s.encryptionKey is configured, the JSON
+// is sealed into an encryption envelope instead of being returned directly.
+func (s *cloudStorage) marshalTLSData(d interface{}) ([]byte, error) {
+	plain, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.encryptionKey == nil {
+		return plain, nil
 	}
 
-	return v.Status == http.StatusNotFound
+	return objectstore.EncryptEnvelope(s.encryptionKey, plain)
+}
+
+// SiteExists returns true if the domain exists. This is a single Stat call,
+// not a listing, so it costs the same whether the bucket holds ten domains
+// or ten million.
+func (s *cloudStorage) SiteExists(domain string) (bool, error) {
+	return s.SiteExistsContext(context.Background(), domain)
 }
 
-// SiteExists returns true if the domain exists.
-func (s *b2Storage) SiteExists(domain string) (res bool, err error) {
+// SiteExistsContext is SiteExists, but lets the caller bound how long the
+// underlying retries run for via ctx. caddytls.Storage has no room for a
+// context argument, so this is the variant to use from call sites that do
+// have one.
+func (s *cloudStorage) SiteExistsContext(ctx context.Context, domain string) (bool, error) {
 	const op = "SiteExists"
 
-	err = s.withBucket(op, func(b *b2.Bucket) error {
-		l := b.ListFiles("")
-		for l.Next() {
-			fi := l.FileInfo()
-			if fi.Name == mkDomainPath(domain) {
-				res = true
-				break
-			}
+	_, err := s.store.Stat(ctx, mkDomainPath(domain))
+	if err != nil {
+		if errors.Is(err, objectstore.ErrNotExist) {
+			return false, nil
 		}
-		return l.Err()
-	})
+		return false, &Error{op: op, err: err}
+	}
 
-	return
+	return true, nil
 }
 
 // LoadSite returns the site data for the domain provided.
-func (s *b2Storage) LoadSite(domain string) (*caddytls.SiteData, error) {
+func (s *cloudStorage) LoadSite(domain string) (*caddytls.SiteData, error) {
+	return s.LoadSiteContext(context.Background(), domain)
+}
+
+// LoadSiteContext is LoadSite, but lets the caller bound how long the
+// underlying retries run for via ctx.
+func (s *cloudStorage) LoadSiteContext(ctx context.Context, domain string) (*caddytls.SiteData, error) {
 	const op = "LoadSite"
 
 	var tmp caddytls.SiteData
 
-	err := s.fetchName(op, mkDomainPath(domain), &tmp)
-	if err != nil {
+	if err := s.fetchName(ctx, op, mkDomainPath(domain), &tmp); err != nil {
 		return nil, err
 	}
-	return &tmp, err
+	return &tmp, nil
 }
 
 // StoreSite stored the site data for the domain provided.
-func (s *b2Storage) StoreSite(domain string, data *caddytls.SiteData) error {
-	const op = "StoreSite"
+func (s *cloudStorage) StoreSite(domain string, data *caddytls.SiteData) error {
+	return s.StoreSiteContext(context.Background(), domain, data)
+}
 
-	return s.withBucket(op, func(b *b2.Bucket) error {
-		buf, err := marshalTLSData(data)
-		if err != nil {
-			return &Error{op: op + "/Marshal", err: err}
-		}
+// StoreSiteContext is StoreSite, but lets the caller bound how long the
+// underlying retries run for via ctx.
+func (s *cloudStorage) StoreSiteContext(ctx context.Context, domain string, data *caddytls.SiteData) error {
+	return s.storeName(ctx, "StoreSite", mkDomainPath(domain), data)
+}
 
-		for i := 0; i < maxRetries; i++ {
-			_, err = b.Upload(buf, mkDomainPath(domain), "")
-			if err == nil {
-				break
-			}
+// DeleteSite delete a site's data.
+func (s *cloudStorage) DeleteSite(domain string) error {
+	return s.DeleteSiteContext(context.Background(), domain)
+}
 
-			time.Sleep(1 * time.Second)
-		}
-		if err != nil {
-			return &Error{op: op + "/Upload", err: err}
-		}
+// DeleteSiteContext is DeleteSite, but lets the caller bound how long the
+// underlying retries run for via ctx.
+func (s *cloudStorage) DeleteSiteContext(ctx context.Context, domain string) error {
+	const op = "DeleteSite"
 
-		return nil
-	})
+	if err := s.store.Delete(ctx, mkDomainPath(domain)); err != nil {
+		return &Error{op: op, err: err}
+	}
+
+	return nil
 }
 
-// DeleteSite delete a site's data.
-func (s *b2Storage) DeleteSite(domain string) error {
-	const op = "DeleteSite"
+// LoadUser returns the user data for the email provided.
+func (s *cloudStorage) LoadUser(email string) (*caddytls.UserData, error) {
+	return s.LoadUserContext(context.Background(), email)
+}
 
-	return s.withBucket(op, func(b *b2.Bucket) error {
-		name := mkDomainPath(domain)
-		var id string
+// LoadUserContext is LoadUser, but lets the caller bound how long the
+// underlying retries run for via ctx.
+func (s *cloudStorage) LoadUserContext(ctx context.Context, email string) (*caddytls.UserData, error) {
+	const op = "LoadUser"
 
-		l := b.ListFiles("")
-		for l.Next() {
-			fi := l.FileInfo()
-			if fi.Name == mkDomainPath(domain) {
-				id = fi.ID
-			}
-		}
+	var tmp caddytls.UserData
 
-		if err := l.Err(); err != nil {
-			return &Error{op: op + "/ListFiles", err: err}
-		}
+	if err := s.fetchName(ctx, op, mkUserPath(email), &tmp); err != nil {
+		return nil, err
+	}
+	return &tmp, nil
+}
 
-		if err := s.client.DeleteFile(id, name); err != nil {
-			return &Error{op: op + "/DeleteFile", err: err}
-		}
+// StoreUser stores the user data for the email provided.
+func (s *cloudStorage) StoreUser(email string, data *caddytls.UserData) error {
+	return s.StoreUserContext(context.Background(), email, data)
+}
 
-		return nil
-	})
+// StoreUserContext is StoreUser, but lets the caller bound how long the
+// underlying retries run for via ctx.
+func (s *cloudStorage) StoreUserContext(ctx context.Context, email string, data *caddytls.UserData) error {
+	if err := s.storeName(ctx, "StoreUser", mkUserPath(email), data); err != nil {
+		return err
+	}
+
+	// The index is an optimization for MostRecentUserEmail; if it can't be
+	// updated, that method just falls back to a full scan, so don't fail
+	// the whole call over it.
+	if err := s.updateUserIndex(ctx, email, time.Now()); err != nil {
+		debugf("StoreUser: updating user index: %v", err)
+	}
+
+	return nil
 }
 
-// LoadUser returns the user data for the email provided.
-func (s *b2Storage) LoadUser(email string) (*caddytls.UserData, error) {
-	const op = "LoadUser"
+// userIndexPath is where the {email: last-stored-time} index used by
+// MostRecentUserEmail lives. Every backend's List/prefix matching is a raw
+// string-prefix test (see e.g. b2Store.List), so this path must be chosen
+// such that it's neither a prefix of mkUserPath("") nor prefixed by it;
+// otherwise a scan of mkUserPath("") (mostRecentUserEmailByScan) or of
+// mkpath("") (MigrateEncrypt) would pick up the index file itself as if it
+// were a user object.
+func userIndexPath() string {
+	return mkpath(filepath.Join("_index", "users.json"))
+}
 
-	var tmp caddytls.UserData
+// userIndex maps a user email to the last time StoreUser was called for it.
+type userIndex map[string]time.Time
 
-	err := s.fetchName(op, mkUserPath(email), &tmp)
+// loadUserIndex reads the user index, returning an empty index if it
+// doesn't exist yet.
+func (s *cloudStorage) loadUserIndex(ctx context.Context) (userIndex, error) {
+	data, err := s.store.Get(ctx, userIndexPath())
 	if err != nil {
+		if errors.Is(err, objectstore.ErrNotExist) {
+			return userIndex{}, nil
+		}
+		return nil, err
+	}
+
+	idx := make(userIndex)
+	if err := json.Unmarshal(data, &idx); err != nil {
 		return nil, err
 	}
-	return &tmp, err
+	return idx, nil
 }
 
-// StoreUser stores the user data for the email provided.
-func (s *b2Storage) StoreUser(email string, data *caddytls.UserData) error {
-	const op = "StoreUser"
+func (s *cloudStorage) storeUserIndex(ctx context.Context, idx userIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(ctx, userIndexPath(), data, "application/json")
+}
 
-	return s.withBucket(op, func(b *b2.Bucket) error {
-		buf, err := marshalTLSData(data)
+// updateUserIndex records that email was stored at when, read-modify-writing
+// the index. Since the backends have no compare-and-swap, it rides out a
+// concurrent writer clobbering the index by re-reading and retrying a few
+// times, verifying after each write that its own entry stuck.
+func (s *cloudStorage) updateUserIndex(ctx context.Context, email string, when time.Time) error {
+	const maxAttempts = 5
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		idx, err := s.loadUserIndex(ctx)
 		if err != nil {
-			return &Error{op: op + "/Marshal", err: err}
+			lastErr = err
+			continue
 		}
 
-		for i := 0; i < maxRetries; i++ {
-			_, err = b.Upload(buf, mkUserPath(email), "")
-			if err == nil {
-				break
-			}
+		idx[email] = when
 
-			time.Sleep(1 * time.Second)
+		if err := s.storeUserIndex(ctx, idx); err != nil {
+			lastErr = err
+			continue
 		}
+
+		verify, err := s.loadUserIndex(ctx)
 		if err != nil {
-			return &Error{op: op + "/Upload", err: err}
+			lastErr = err
+			continue
+		}
+		if t, ok := verify[email]; ok && t.Equal(when) {
+			return nil
 		}
 
-		return nil
-	})
+		lastErr = fmt.Errorf("write for %q was clobbered by a concurrent writer", email)
+	}
+
+	return lastErr
 }
 
 // MostRecentUserEmail returns the most recently used user email.
-func (s *b2Storage) MostRecentUserEmail() (res string) {
+//
+// This reads the users/_index.json index built up by StoreUser, which is a
+// single fetchName-style call instead of a full listing of every user
+// object. If the index is missing (e.g. a bucket written before this index
+// existed), it falls back to the old full scan and seeds the index from the
+// result so later calls are fast.
+func (s *cloudStorage) MostRecentUserEmail() string {
+	return s.MostRecentUserEmailContext(context.Background())
+}
+
+// MostRecentUserEmailContext is MostRecentUserEmail, but lets the caller
+// bound how long the underlying retries run for via ctx.
+func (s *cloudStorage) MostRecentUserEmailContext(ctx context.Context) string {
 	const op = "MostRecentUserEmail"
 
-	s.withBucket(op, func(b *b2.Bucket) error {
-		type emailWithTime struct {
-			email string
-			time  time.Time
+	data, err := s.store.Get(ctx, userIndexPath())
+	if err == nil {
+		var idx userIndex
+		if err := json.Unmarshal(data, &idx); err == nil && len(idx) > 0 {
+			return mostRecentFromIndex(idx)
 		}
+	} else if !errors.Is(err, objectstore.ErrNotExist) {
+		debugf("%s: reading index: %v", op, err)
+	}
 
-		var emails []emailWithTime
+	return s.mostRecentUserEmailByScan(ctx)
+}
 
-		l := b.ListFiles("")
-		for l.Next() {
-			fi := l.FileInfo()
+func mostRecentFromIndex(idx userIndex) string {
+	var mostRecent string
+	var mostRecentTime time.Time
 
-			emails = append(emails, emailWithTime{
-				email: filepath.Base(fi.Name),
-				time:  fi.UploadTimestamp,
-			})
+	for email, t := range idx {
+		if mostRecent == "" || t.After(mostRecentTime) {
+			mostRecent = email
+			mostRecentTime = t
 		}
+	}
 
-		sort.Slice(emails, func(i, j int) bool {
-			// Reverse sort: most recent first
-			return emails[i].time.After(emails[j].time)
-		})
+	return mostRecent
+}
 
-		res = emails[0].email
+// mostRecentUserEmailByScan is the pre-index implementation: it lists every
+// user object and compares modification times. It's only used when the
+// users/_index.json index doesn't exist yet.
+func (s *cloudStorage) mostRecentUserEmailByScan(ctx context.Context) string {
+	const op = "MostRecentUserEmail"
 
-		return nil
-	})
+	var mostRecent string
+	var mostRecentTime time.Time
+	idx := make(userIndex)
 
-	return
-}
+	it := s.store.List(ctx, mkUserPath(""))
+	for it.Next() {
+		info := it.Info()
+		email := filepath.Base(info.Key)
+		idx[email] = info.ModTime
 
-// TryLock tries to take a lock.
-// WARNING: this is only a local lock right now.
-func (s *b2Storage) TryLock(name string) (caddytls.Waiter, error) {
-	wg := s.waiters.forName(name)
-	if wg != nil {
-		return wg, nil
+		if mostRecent == "" || info.ModTime.After(mostRecentTime) {
+			mostRecent = email
+			mostRecentTime = info.ModTime
+		}
+	}
+	if err := it.Err(); err != nil {
+		debugf("%s: %v", op, err)
+		return ""
 	}
 
-	s.waiters.add(name)
+	// Best-effort: seed the index so the next call doesn't need to scan.
+	if err := s.storeUserIndex(ctx, idx); err != nil {
+		debugf("%s: seeding index: %v", op, err)
+	}
 
-	return nil, nil
+	return mostRecent
 }
 
-// Unlock removes a lock.
-// WARNING: this is only a local lock right now.
-func (s *b2Storage) Unlock(name string) error {
-	s.waiters.remove(name)
-	return nil
+// TryLock tries to take a distributed lock for name. See
+// internal/objectstore.Locker for details.
+func (s *cloudStorage) TryLock(name string) (caddytls.Waiter, error) {
+	return s.TryLockContext(context.Background(), name)
 }
 
-const maxRetries = 5
+// TryLockContext is TryLock, but lets the caller bound how long the
+// underlying retries run for via ctx.
+func (s *cloudStorage) TryLockContext(ctx context.Context, name string) (caddytls.Waiter, error) {
+	w, err := s.locker.TryLock(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Unlock releases the lock for name.
+func (s *cloudStorage) Unlock(name string) error {
+	return s.UnlockContext(context.Background(), name)
+}
+
+// UnlockContext is Unlock, but lets the caller bound how long the underlying
+// retries run for via ctx.
+func (s *cloudStorage) UnlockContext(ctx context.Context, name string) error {
+	return s.locker.Unlock(ctx, name)
+}
 
 // it's a var so we can override it in tests.
 var prefix = "caddytls"
@@ -314,67 +602,16 @@ func mkUserPath(path string) string {
 	return mkpath(filepath.Join("user", path))
 }
 
-// Error represents an error from tlsb2
+// Error represents an error from tlsb2.
 type Error struct {
 	op  string
 	err error
 }
 
 func (e *Error) Error() string {
-	v, ok := b2.UnwrapError(e.err)
-	if ok {
+	if v, ok := b2.UnwrapError(e.err); ok {
 		return fmt.Sprintf("op:%s b2:%v", e.op, v)
 	}
 
 	return fmt.Sprintf("op:%s err:%v", e.op, e.err)
 }
-
-func marshalTLSData(d interface{}) (*bytes.Buffer, error) {
-	buf := new(bytes.Buffer)
-	enc := json.NewEncoder(buf)
-
-	err := enc.Encode(d)
-
-	return buf, err
-}
-
-type waiters struct {
-	mu  sync.Mutex
-	wgs map[string]*sync.WaitGroup
-}
-
-func newWaiters() *waiters {
-	return &waiters{
-		wgs: make(map[string]*sync.WaitGroup),
-	}
-}
-
-func (w *waiters) forName(name string) *sync.WaitGroup {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	return w.wgs[name]
-}
-
-func (w *waiters) add(name string) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-
-	w.wgs[name] = wg
-}
-
-func (w *waiters) remove(name string) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	wg, ok := w.wgs[name]
-	if !ok {
-		return
-	}
-
-	wg.Done()
-	delete(w.wgs, name)
-}
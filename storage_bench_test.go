@@ -0,0 +1,188 @@
+package tlsb2
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"rischmann.fr/caddy-tlsb2/internal/objectstore"
+)
+
+// memStore is a trivial in-memory objectstore.Store. Unlike storage_test.go
+// (which needs a live B2 bucket and is gated behind "+build full"), this
+// lets BenchmarkSiteExists below populate a "bucket" with thousands of
+// objects without touching the network, to demonstrate that SiteExists
+// stays flat as the bucket grows.
+type memStore struct {
+	mu   sync.Mutex
+	objs map[string][]byte
+	mod  map[string]time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{objs: make(map[string][]byte), mod: make(map[string]time.Time)}
+}
+
+func (s *memStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objs[key] = append([]byte(nil), data...)
+	s.mod[key] = time.Now()
+	return nil
+}
+
+func (s *memStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objs[key]
+	if !ok {
+		return nil, objectstore.ErrNotExist
+	}
+	return data, nil
+}
+
+func (s *memStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objs[key]; !ok {
+		return objectstore.ErrNotExist
+	}
+	delete(s.objs, key)
+	delete(s.mod, key)
+	return nil
+}
+
+func (s *memStore) Stat(ctx context.Context, key string) (objectstore.Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objs[key]
+	if !ok {
+		return objectstore.Info{}, objectstore.ErrNotExist
+	}
+	return objectstore.Info{Key: key, Size: int64(len(data)), ModTime: s.mod[key]}, nil
+}
+
+func (s *memStore) List(ctx context.Context, prefix string) objectstore.Iterator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for k := range s.objs {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return &memIterator{store: s, keys: keys}
+}
+
+type memIterator struct {
+	store *memStore
+	keys  []string
+	idx   int
+	info  objectstore.Info
+}
+
+func (it *memIterator) Next() bool {
+	if it.idx >= len(it.keys) {
+		return false
+	}
+	key := it.keys[it.idx]
+	it.idx++
+
+	it.store.mu.Lock()
+	data := it.store.objs[key]
+	modTime := it.store.mod[key]
+	it.store.mu.Unlock()
+
+	it.info = objectstore.Info{Key: key, Size: int64(len(data)), ModTime: modTime}
+	return true
+}
+
+func (it *memIterator) Key() string            { return it.info.Key }
+func (it *memIterator) Info() objectstore.Info { return it.info }
+func (it *memIterator) Err() error             { return nil }
+
+// benchCloudStorage returns a cloudStorage backed by an in-memory store
+// pre-populated with n dummy domains, so benchmarks can measure how
+// SiteExists scales with bucket size without a live B2 bucket.
+func benchCloudStorage(b *testing.B, n int) *cloudStorage {
+	store := newMemStore()
+	ctx := context.Background()
+
+	for i := 0; i < n; i++ {
+		domain := fmt.Sprintf("site-%d.example.com", i)
+		if err := store.Put(ctx, mkDomainPath(domain), []byte("x"), ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return &cloudStorage{store: store, locker: objectstore.NewLocker(store, objectstore.DefaultLockTTL), backend: "mem"}
+}
+
+// BenchmarkSiteExists demonstrates that SiteExists costs the same regardless
+// of how many other domains are in the bucket: it's a single Stat lookup,
+// never a scan over every stored object.
+func BenchmarkSiteExists(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			s := benchCloudStorage(b, n)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.SiteExists("site-1.example.com"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMostRecentUserEmail demonstrates the users/_index.json index
+// keeping lookups flat as the number of users grows, versus the full-scan
+// fallback used when the index is missing.
+func BenchmarkMostRecentUserEmail(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("indexed/n=%d", n), func(b *testing.B) {
+			s := benchCloudStorage(b, 0)
+			ctx := context.Background()
+
+			idx := make(userIndex, n)
+			for i := 0; i < n; i++ {
+				idx[fmt.Sprintf("user-%d@example.com", i)] = time.Now()
+			}
+			if err := s.storeUserIndex(ctx, idx); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.MostRecentUserEmail()
+			}
+		})
+	}
+
+	b.Run("scan-fallback/n=1000", func(b *testing.B) {
+		s := benchCloudStorage(b, 0)
+		ctx := context.Background()
+
+		for i := 0; i < 1000; i++ {
+			email := fmt.Sprintf("user-%d@example.com", i)
+			if err := s.store.Put(ctx, mkUserPath(email), []byte("{}"), ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+		// The loop above wrote user objects directly, bypassing StoreUser, so
+		// no index was ever created; every iteration hits the scan fallback.
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.mostRecentUserEmailByScan(ctx)
+		}
+	})
+}
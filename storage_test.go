@@ -4,11 +4,15 @@ package tlsb2
 
 import (
 	"bytes"
+	"context"
 	"net/url"
-	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mholt/caddy/caddytls"
+
+	"rischmann.fr/caddy-tlsb2/internal/objectstore"
 )
 
 const testCAURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
@@ -31,36 +35,21 @@ func initStorage(t *testing.T) caddytls.Storage {
 }
 
 func truncateStorage(t *testing.T, s *b2Storage) {
-	bucket, err := s.client.BucketByName(s.bucketName, false)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	type fileToDelete struct {
-		name string
-		id   string
-	}
+	ctx := context.Background()
+	store := s.backend().store
 
-	var toDelete []fileToDelete
+	var keys []string
 
-	l := bucket.ListFilesVersions("", "")
-	for l.Next() {
-		fi := l.FileInfo()
-		if strings.HasPrefix(fi.Name, prefix) {
-			toDelete = append(toDelete, fileToDelete{
-				name: fi.Name,
-				id:   fi.ID,
-			})
-		}
+	it := store.List(ctx, prefix)
+	for it.Next() {
+		keys = append(keys, it.Key())
 	}
-
-	if err := l.Err(); err != nil {
+	if err := it.Err(); err != nil {
 		t.Fatal(err)
 	}
 
-	for _, v := range toDelete {
-		err := s.client.DeleteFile(v.id, v.name)
-		if err != nil {
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -208,3 +197,156 @@ func TestUser(t *testing.T) {
 		}
 	})
 }
+
+// TestConcurrentLock acquires the same lock name from two goroutines at
+// once and checks that exactly one of them gets the lock immediately while
+// the other has to wait for it to be released.
+func TestConcurrentLock(t *testing.T) {
+	s := initStorage(t)
+
+	const name = "concurrent-lock-test"
+
+	type result struct {
+		waiter caddytls.Waiter
+	}
+
+	results := make(chan result, 2)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+
+			waiter, err := s.TryLock(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			results <- result{waiter: waiter}
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+
+	var waiters int
+	var holders int
+
+	for r := range results {
+		if r.waiter != nil {
+			waiters++
+		} else {
+			holders++
+		}
+	}
+
+	if holders != 1 {
+		t.Fatalf("expected exactly one goroutine to acquire the lock, got %d", holders)
+	}
+	if waiters != 1 {
+		t.Fatalf("expected exactly one goroutine to be given a waiter, got %d", waiters)
+	}
+
+	if err := s.Unlock(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStoreLoadWithEncryption stores and loads a site under both plaintext
+// and encrypted modes, and checks that the encrypted payload on disk does
+// not contain the plaintext.
+func TestStoreLoadWithEncryption(t *testing.T) {
+	s := initStorage(t).(*b2Storage)
+
+	const domain = "encrypted.example.com"
+
+	siteData := &caddytls.SiteData{
+		Cert: []byte("cert-bytes"),
+		Key:  []byte("key-bytes"),
+		Meta: []byte("meta-bytes"),
+	}
+
+	t.Run("plaintext", func(t *testing.T) {
+		s.encryptionKey = nil
+
+		if err := s.StoreSite(domain, siteData); err != nil {
+			t.Fatal(err)
+		}
+
+		tmp, err := s.LoadSite(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tmp.Cert, siteData.Cert) {
+			t.Fatalf("expected cert %q, got %q", siteData.Cert, tmp.Cert)
+		}
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		key := make([]byte, 32)
+		for i := range key {
+			key[i] = byte(i)
+		}
+		s.encryptionKey = key
+
+		if err := s.StoreSite(domain, siteData); err != nil {
+			t.Fatal(err)
+		}
+
+		// fetchName transparently decrypts, so read the raw object directly
+		// to check what actually landed in the bucket.
+		data, err := s.backend().store.Get(context.Background(), mkDomainPath(domain))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(data, siteData.Cert) {
+			t.Fatalf("expected the stored payload to not contain the plaintext cert")
+		}
+
+		if _, ok := objectstore.LooksLikeEnvelope(data); !ok {
+			t.Fatalf("expected the stored payload to be an envelope, got %s", data)
+		}
+
+		tmp, err := s.LoadSite(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tmp.Cert, siteData.Cert) {
+			t.Fatalf("expected cert %q, got %q", siteData.Cert, tmp.Cert)
+		}
+	})
+
+	s.encryptionKey = nil
+	if err := s.DeleteSite(domain); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLockTTL checks that a stale lock (older than the configured TTL) can
+// be broken by a fresh acquirer.
+func TestLockTTL(t *testing.T) {
+	s := initStorage(t)
+	cs := s.(*b2Storage).backend()
+	cs.locker = objectstore.NewLocker(cs.store, 50*time.Millisecond)
+
+	const name = "stale-lock-test"
+
+	_, err := s.TryLock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	waiter, err := s.TryLock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waiter != nil {
+		t.Fatalf("expected the stale lock to be broken and the lock to be acquired immediately")
+	}
+}